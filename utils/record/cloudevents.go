@@ -0,0 +1,443 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+
+	rolloutsv1alpha1 "github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+)
+
+const (
+	// cloudEventsConfigMapKey is the key in the notifications ConfigMap that holds the
+	// list of CloudEvents sinks, serialized as YAML.
+	cloudEventsConfigMapKey = "cloudevents.sinks"
+	cloudEventsSpecVersion  = "1.0"
+	// cloudEventsSourceFormat is rooted at the emitting controller's identity (its pod name
+	// and leader-election identity, see EventRecorderAdapter.controllerInstance) so events
+	// from different controller replicas/clusters are distinguishable downstream.
+	cloudEventsSourceFormat = "/%s/apis/rollouts.argoproj.io/%s/%s"
+
+	// cloudEventsCircuitBreakerThreshold is the number of consecutive delivery failures
+	// to a sink before the circuit is opened and subsequent sends are skipped.
+	cloudEventsCircuitBreakerThreshold = 5
+	// cloudEventsCircuitBreakerCooldown is how long a sink's circuit stays open before
+	// delivery is attempted again.
+	cloudEventsCircuitBreakerCooldown = 30 * time.Second
+
+	// DefaultCloudEventQueueSize is the default bound on the number of pending CloudEvent
+	// deliveries an EventRecorderAdapter will hold before dropping new ones.
+	DefaultCloudEventQueueSize = 1000
+	// DefaultCloudEventWorkers is the default number of goroutines draining the CloudEvent
+	// delivery queue.
+	DefaultCloudEventWorkers = 4
+)
+
+// CloudEventTLSConfig configures TLS verification for a CloudEvents HTTP sink.
+type CloudEventTLSConfig struct {
+	// InsecureSkipVerify disables TLS certificate verification. Not recommended.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// CACertPEM is a PEM encoded CA bundle used to verify the sink's certificate.
+	CACertPEM string `json:"caCertPEM,omitempty"`
+}
+
+// CloudEventRetryConfig configures retry/backoff behavior for a CloudEvents sink.
+type CloudEventRetryConfig struct {
+	// MaxAttempts is the maximum number of delivery attempts, including the first. Defaults to 3.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// InitialBackoff is the delay before the first retry (e.g. "500ms"). Defaults to 500ms.
+	InitialBackoff string `json:"initialBackoff,omitempty"`
+}
+
+// CloudEventSink is a single CloudEvents v1.0 HTTP destination configured in the
+// notifications ConfigMap that receives a structured event for every triggered
+// BuiltInTriggers reason.
+type CloudEventSink struct {
+	// Name uniquely identifies the sink and is used as the `sink` label on
+	// rollout_cloudevents_delivery_total.
+	Name string `json:"name"`
+	// URL is the HTTP(S) endpoint events are POSTed to.
+	URL string `json:"url"`
+	// Headers are additional HTTP headers sent with every request (e.g. auth tokens).
+	Headers map[string]string `json:"headers,omitempty"`
+	// Retry configures the delivery retry policy. Optional.
+	Retry *CloudEventRetryConfig `json:"retry,omitempty"`
+	// TLS configures certificate verification for https:// sinks. Optional.
+	TLS *CloudEventTLSConfig `json:"tls,omitempty"`
+}
+
+// cloudEvent is a CloudEvents v1.0 envelope. See https://github.com/cloudevents/spec.
+type cloudEvent struct {
+	SpecVersion     string         `json:"specversion"`
+	ID              string         `json:"id"`
+	Source          string         `json:"source"`
+	Type            string         `json:"type"`
+	Subject         string         `json:"subject"`
+	Time            string         `json:"time"`
+	DataContentType string         `json:"datacontenttype"`
+	Data            cloudEventData `json:"data"`
+}
+
+type cloudEventData struct {
+	Rollout json.RawMessage `json:"rollout"`
+	Reason  string          `json:"reason"`
+	Message string          `json:"message"`
+	// Step is the rollout's current canary step index, if any.
+	Step *int32 `json:"step,omitempty"`
+	// Weight is the rollout's current canary traffic weight, if any.
+	Weight *int32 `json:"weight,omitempty"`
+}
+
+// currentStepAndWeight extracts the current canary step index and traffic weight from
+// rollout's status, if object is a Rollout. Non-Rollout objects (e.g. ReplicaSets) have
+// neither and both return values are nil.
+func currentStepAndWeight(object runtime.Object) (step *int32, weight *int32) {
+	rollout, ok := object.(*rolloutsv1alpha1.Rollout)
+	if !ok {
+		return nil, nil
+	}
+	step = rollout.Status.CurrentStepIndex
+	if rollout.Status.Canary.Weights != nil {
+		w := rollout.Status.Canary.Weights.Canary.Weight
+		weight = &w
+	}
+	return step, weight
+}
+
+// cloudEventsCircuitBreaker tracks consecutive failures for a single sink so that a
+// persistently unreachable endpoint doesn't hold up every subsequent rollout event. It is
+// accessed concurrently by the cloudEventDispatcher's workers, each running deliverCloudEvent,
+// so its fields are guarded by a mutex rather than assumed single-threaded.
+type cloudEventsCircuitBreaker struct {
+	lock                sync.Mutex
+	consecutiveFailures int
+	openUntil           time.Time
+}
+
+func (b *cloudEventsCircuitBreaker) open() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.openUntil.After(time.Now())
+}
+
+func (b *cloudEventsCircuitBreaker) recordResult(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		b.consecutiveFailures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.consecutiveFailures++
+	if b.consecutiveFailures >= cloudEventsCircuitBreakerThreshold {
+		b.openUntil = time.Now().Add(cloudEventsCircuitBreakerCooldown)
+	}
+}
+
+// cloudEventDeliveryJob is a single (sink, event) pair queued for delivery.
+type cloudEventDeliveryJob struct {
+	sink CloudEventSink
+	ev   cloudEvent
+}
+
+// cloudEventDispatcher is a bounded worker pool that decouples CloudEvents HTTP delivery
+// (including postCloudEvent's blocking retry/backoff) from the Eventf/Warnf caller, the same
+// way notificationDispatcher decouples notifications-engine delivery: a slow or unreachable
+// sink (before its circuit breaker trips) can never pile up unbounded per-event goroutines.
+type cloudEventDispatcher struct {
+	adapter *EventRecorderAdapter
+	queue   chan cloudEventDeliveryJob
+
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+func newCloudEventDispatcher(adapter *EventRecorderAdapter, queueSize, workers int) *cloudEventDispatcher {
+	if queueSize <= 0 {
+		queueSize = DefaultCloudEventQueueSize
+	}
+	if workers <= 0 {
+		workers = DefaultCloudEventWorkers
+	}
+	d := &cloudEventDispatcher{
+		adapter: adapter,
+		queue:   make(chan cloudEventDeliveryJob, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return d
+}
+
+// enqueue buffers job for delivery by a worker. If the queue is full, job is dropped and
+// rollout_cloudevents_delivery_total{sink=job.sink.Name, result="dropped"} is incremented
+// instead of spawning an unbounded goroutine. A job enqueued after Close is dropped and counted
+// the same way.
+func (d *cloudEventDispatcher) enqueue(job cloudEventDeliveryJob) {
+	defer func() {
+		// Sending on the queue Close has closed panics; treat it as a drop.
+		if recover() != nil {
+			d.adapter.recordCloudEventDelivery(job.sink.Name, "dropped")
+		}
+	}()
+	select {
+	case d.queue <- job:
+	default:
+		d.adapter.recordCloudEventDelivery(job.sink.Name, "dropped")
+	}
+}
+
+func (d *cloudEventDispatcher) worker() {
+	defer d.wg.Done()
+	for job := range d.queue {
+		d.adapter.deliverCloudEvent(job.sink, job.ev)
+	}
+}
+
+// Close stops accepting new events and waits for in-flight deliveries to drain, up to ctx's
+// deadline.
+func (d *cloudEventDispatcher) Close(ctx context.Context) error {
+	var err error
+	d.stopOnce.Do(func() {
+		close(d.queue)
+		done := make(chan struct{})
+		go func() {
+			d.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	})
+	return err
+}
+
+// LoadCloudEventSinks parses the CloudEvents sink list out of the notifications ConfigMap.
+// The ConfigMap stores the sinks as YAML under the "cloudevents.sinks" key. An absent key
+// is not an error and results in no sinks being configured.
+func LoadCloudEventSinks(configMap *corev1.ConfigMap) ([]CloudEventSink, error) {
+	if configMap == nil {
+		return nil, nil
+	}
+	raw, ok := configMap.Data[cloudEventsConfigMapKey]
+	if !ok || raw == "" {
+		return nil, nil
+	}
+	var sinks []CloudEventSink
+	if err := yaml.Unmarshal([]byte(raw), &sinks); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", cloudEventsConfigMapKey, err)
+	}
+	return sinks, nil
+}
+
+// SetCloudEventSinks replaces the set of CloudEvents sinks the recorder delivers to. It is
+// safe to call concurrently with event recording; callers typically invoke this whenever the
+// notifications ConfigMap changes.
+func (e *EventRecorderAdapter) SetCloudEventSinks(sinks []CloudEventSink) {
+	e.cloudEventSinksLock.Lock()
+	defer e.cloudEventSinksLock.Unlock()
+	e.cloudEventSinks = sinks
+	e.cloudEventBreakers = make(map[string]*cloudEventsCircuitBreaker, len(sinks))
+	for _, sink := range sinks {
+		e.cloudEventBreakers[sink.Name] = &cloudEventsCircuitBreaker{}
+	}
+}
+
+func (e *EventRecorderAdapter) getCloudEventSinks() []CloudEventSink {
+	e.cloudEventSinksLock.RLock()
+	defer e.cloudEventSinksLock.RUnlock()
+	return e.cloudEventSinks
+}
+
+// sendCloudEvents dual-emits a CloudEvent for object/opts to every configured sink, for
+// triggered BuiltInTriggers reasons (and warnings). Delivery is asynchronous and failures
+// are recorded on rollout_cloudevents_delivery_total rather than returned, mirroring how
+// Eventf/Warnf never block the caller on notification delivery.
+func (e *EventRecorderAdapter) sendCloudEvents(object runtime.Object, opts EventOptions, messageFmt string, args []interface{}) {
+	sinks := e.getCloudEventSinks()
+	if len(sinks) == 0 {
+		return
+	}
+	trigger, ok := EventReasonToTrigger[opts.EventReason]
+	if !ok && opts.EventType != corev1.EventTypeWarning {
+		return
+	}
+	if trigger == "" {
+		trigger = "warning"
+	}
+
+	objBytes, err := json.Marshal(object)
+	if err != nil {
+		log.Errorf("failed to marshal object for cloudevent: %s", err.Error())
+		return
+	}
+	step, weight := currentStepAndWeight(object)
+	ev := cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              uuid.NewString(),
+		Source:          e.cloudEventSource(object),
+		Type:            fmt.Sprintf("io.argoproj.rollouts.rollout.%s", trigger),
+		Subject:         cloudEventSubject(object),
+		Time:            time.Now().UTC().Format(time.RFC3339),
+		DataContentType: "application/json",
+		Data: cloudEventData{
+			Rollout: objBytes,
+			Reason:  opts.EventReason,
+			Message: fmt.Sprintf(messageFmt, args...),
+			Step:    step,
+			Weight:  weight,
+		},
+	}
+
+	dispatcher := e.getCloudEventDispatcher()
+	for _, sink := range sinks {
+		dispatcher.enqueue(cloudEventDeliveryJob{sink: sink, ev: ev})
+	}
+}
+
+func (e *EventRecorderAdapter) deliverCloudEvent(sink CloudEventSink, ev cloudEvent) {
+	e.cloudEventSinksLock.RLock()
+	breaker := e.cloudEventBreakers[sink.Name]
+	e.cloudEventSinksLock.RUnlock()
+	if breaker != nil && breaker.open() {
+		e.recordCloudEventDelivery(sink.Name, "circuit_open")
+		return
+	}
+
+	err := postCloudEvent(sink, ev)
+	if breaker != nil {
+		breaker.recordResult(err)
+	}
+	if err != nil {
+		log.Errorf("cloudevents delivery to sink %q failed: %s", sink.Name, err.Error())
+		e.recordCloudEventDelivery(sink.Name, "error")
+		return
+	}
+	e.recordCloudEventDelivery(sink.Name, "success")
+}
+
+func (e *EventRecorderAdapter) recordCloudEventDelivery(sink, result string) {
+	if e.CloudEventDeliveryCounter == nil {
+		return
+	}
+	e.CloudEventDeliveryCounter.WithLabelValues(sink, result).Inc()
+}
+
+func postCloudEvent(sink CloudEventSink, ev cloudEvent) error {
+	client, err := cloudEventHTTPClient(sink)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	maxAttempts := 3
+	if sink.Retry != nil && sink.Retry.MaxAttempts > 0 {
+		maxAttempts = sink.Retry.MaxAttempts
+	}
+	backoff := 500 * time.Millisecond
+	if sink.Retry != nil && sink.Retry.InitialBackoff != "" {
+		if d, err := time.ParseDuration(sink.Retry.InitialBackoff); err == nil {
+			backoff = d
+		}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		lastErr = doPostCloudEvent(client, sink, body)
+		if lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+func doPostCloudEvent(client *http.Client, sink CloudEventSink, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	for k, v := range sink.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sink %q returned status %d", sink.Name, resp.StatusCode)
+	}
+	return nil
+}
+
+func cloudEventHTTPClient(sink CloudEventSink) (*http.Client, error) {
+	if sink.TLS == nil {
+		return http.DefaultClient, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: sink.TLS.InsecureSkipVerify}
+	if sink.TLS.CACertPEM != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(sink.TLS.CACertPEM)) {
+			return nil, fmt.Errorf("failed to parse CA certificate for sink %q", sink.Name)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// cloudEventSource derives the CloudEvent `source` field from this controller's identity (pod
+// name + leader-election identity, see controllerInstance) and the object's namespace/name, so
+// events emitted by different controller replicas or clusters are distinguishable downstream.
+func (e *EventRecorderAdapter) cloudEventSource(object runtime.Object) string {
+	kind, namespace, name := objectRefParts(object)
+	controller := e.controllerInstance
+	if controller == "" {
+		controller = controllerAgentName
+	}
+	return fmt.Sprintf(cloudEventsSourceFormat, controller, namespace, name) + "/" + kind
+}
+
+func cloudEventSubject(object runtime.Object) string {
+	_, namespace, name := objectRefParts(object)
+	return fmt.Sprintf("%s/%s", namespace, name)
+}
+
+func objectRefParts(object runtime.Object) (kind, namespace, name string) {
+	kind = object.GetObjectKind().GroupVersionKind().Kind
+	accessor, ok := object.(metav1.Object)
+	if !ok {
+		return kind, "", ""
+	}
+	return kind, accessor.GetNamespace(), accessor.GetName()
+}
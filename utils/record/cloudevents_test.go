@@ -0,0 +1,157 @@
+package record
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	rolloutsv1alpha1 "github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+)
+
+func TestLoadCloudEventSinks(t *testing.T) {
+	cm := &corev1.ConfigMap{Data: map[string]string{
+		cloudEventsConfigMapKey: `
+- name: primary
+  url: https://example.com/events
+  headers:
+    Authorization: Bearer xyz
+`,
+	}}
+
+	sinks, err := LoadCloudEventSinks(cm)
+	require.NoError(t, err)
+	require.Len(t, sinks, 1)
+	assert.Equal(t, "primary", sinks[0].Name)
+	assert.Equal(t, "https://example.com/events", sinks[0].URL)
+	assert.Equal(t, "Bearer xyz", sinks[0].Headers["Authorization"])
+}
+
+func TestLoadCloudEventSinksNoKey(t *testing.T) {
+	sinks, err := LoadCloudEventSinks(&corev1.ConfigMap{})
+	require.NoError(t, err)
+	assert.Nil(t, sinks)
+}
+
+func TestCloudEventsCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	b := &cloudEventsCircuitBreaker{}
+	assert.False(t, b.open())
+
+	for i := 0; i < cloudEventsCircuitBreakerThreshold; i++ {
+		b.recordResult(assert.AnError)
+	}
+	assert.True(t, b.open())
+
+	b.recordResult(nil)
+	assert.False(t, b.open())
+}
+
+// TestCloudEventsCircuitBreakerConcurrentAccess exercises open()/recordResult() from many
+// goroutines at once, mirroring the cloudEventDispatcher's workers running deliverCloudEvent
+// concurrently. Run with
+// -race to catch data races on consecutiveFailures/openUntil.
+func TestCloudEventsCircuitBreakerConcurrentAccess(t *testing.T) {
+	b := &cloudEventsCircuitBreaker{}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				b.recordResult(assert.AnError)
+			} else {
+				b.recordResult(nil)
+			}
+			b.open()
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCurrentStepAndWeight(t *testing.T) {
+	stepIdx := int32(2)
+	rollout := &rolloutsv1alpha1.Rollout{
+		Status: rolloutsv1alpha1.RolloutStatus{
+			CurrentStepIndex: &stepIdx,
+			Canary: rolloutsv1alpha1.CanaryStatus{
+				Weights: &rolloutsv1alpha1.TrafficWeights{
+					Canary: rolloutsv1alpha1.WeightDestination{Weight: 40},
+				},
+			},
+		},
+	}
+
+	step, weight := currentStepAndWeight(rollout)
+	require.NotNil(t, step)
+	require.NotNil(t, weight)
+	assert.Equal(t, int32(2), *step)
+	assert.Equal(t, int32(40), *weight)
+}
+
+func TestCurrentStepAndWeightNonRollout(t *testing.T) {
+	rs := &corev1.Pod{}
+	step, weight := currentStepAndWeight(rs)
+	assert.Nil(t, step)
+	assert.Nil(t, weight)
+}
+
+func TestCloudEventsCircuitBreakerCooldownExpires(t *testing.T) {
+	b := &cloudEventsCircuitBreaker{
+		consecutiveFailures: cloudEventsCircuitBreakerThreshold,
+		openUntil:           time.Now().Add(-time.Second),
+	}
+	assert.False(t, b.open())
+}
+
+func TestCloudEventSourceIncludesControllerInstance(t *testing.T) {
+	adapter := &EventRecorderAdapter{controllerInstance: "rollouts-controller-0/leader-abc"}
+	rs := &appsv1.ReplicaSet{
+		TypeMeta:   metav1.TypeMeta{Kind: "ReplicaSet"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "canary-abc123"},
+	}
+	assert.Equal(t, "/rollouts-controller-0/leader-abc/apis/rollouts.argoproj.io/default/canary-abc123/ReplicaSet", adapter.cloudEventSource(rs))
+}
+
+func TestCloudEventSourceFallsBackToControllerAgentNameWhenUnset(t *testing.T) {
+	adapter := &EventRecorderAdapter{}
+	rs := &appsv1.ReplicaSet{
+		TypeMeta:   metav1.TypeMeta{Kind: "ReplicaSet"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "canary-abc123"},
+	}
+	assert.Equal(t, "/"+controllerAgentName+"/apis/rollouts.argoproj.io/default/canary-abc123/ReplicaSet", adapter.cloudEventSource(rs))
+}
+
+// TestCloudEventDispatcherDropsWhenQueueFull exercises the bounded worker pool sendCloudEvents
+// routes deliveries through, so a slow/unreachable sink can never pile up unbounded goroutines:
+// once the queue is full, further deliveries are dropped and counted rather than spawning a
+// new goroutine per event.
+func TestCloudEventDispatcherDropsWhenQueueFull(t *testing.T) {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_cloudevents_delivery_total"}, []string{"sink", "result"})
+	adapter := &EventRecorderAdapter{CloudEventDeliveryCounter: counter}
+	d := &cloudEventDispatcher{adapter: adapter, queue: make(chan cloudEventDeliveryJob, 1)}
+
+	d.enqueue(cloudEventDeliveryJob{sink: CloudEventSink{Name: "primary"}})
+	d.enqueue(cloudEventDeliveryJob{sink: CloudEventSink{Name: "primary"}})
+
+	assert.Equal(t, 1, len(d.queue))
+	m := &dto.Metric{}
+	require.NoError(t, counter.WithLabelValues("primary", "dropped").Write(m))
+	assert.Equal(t, float64(1), m.GetCounter().GetValue())
+}
+
+func TestCloudEventDispatcherCloseIsIdempotent(t *testing.T) {
+	d := newCloudEventDispatcher(&EventRecorderAdapter{}, 1, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, d.Close(ctx))
+	require.NoError(t, d.Close(ctx))
+}
@@ -0,0 +1,125 @@
+package record
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+	"k8s.io/kubectl/pkg/scheme"
+)
+
+// rolloutsUIDNamespace is a fixed namespace UUID used to derive stable, deterministic object
+// UIDs for events whose InvolvedObject has no real UID available (e.g. objects reconstructed
+// purely from a name/namespace/kind tuple). Derived UIDs are stable across processes because
+// they only depend on kind/namespace/name, never on wall-clock time or randomness.
+var rolloutsUIDNamespace = uuid.MustParse("e6df4a58-8c31-4b6a-9a3e-39dbb7f00e01")
+
+// deterministicUID derives a stable UID from <kind>/<namespace>/<name> so that repeated
+// events about the same logical object correlate even when the real Kubernetes UID isn't
+// known to the caller.
+func deterministicUID(kind, namespace, name string) types.UID {
+	key := fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+	return types.UID(uuid.NewSHA1(rolloutsUIDNamespace, []byte(key)).String())
+}
+
+// withStableUID returns a shallow copy of object with its UID set, deriving a deterministic
+// one from its kind/namespace/name when the object doesn't already carry a real UID. This
+// ensures InvolvedObject.UID is always populated and stable, so k8s's event aggregator and
+// downstream correlation queries can group repeated events for the same object.
+func withStableUID(object runtime.Object) runtime.Object {
+	accessor, ok := object.(metav1.Object)
+	if !ok || accessor.GetUID() != "" {
+		return object
+	}
+	copied := object.DeepCopyObject()
+	copiedAccessor := copied.(metav1.Object)
+	kind := object.GetObjectKind().GroupVersionKind().Kind
+	copiedAccessor.SetUID(deterministicUID(kind, copiedAccessor.GetNamespace(), copiedAccessor.GetName()))
+	return copied
+}
+
+// controllerInstance identifies the specific controller process emitting events, so
+// dashboards can group events by controller instance (pod name + leader-election identity)
+// as well as by InvolvedObject.UID.
+func controllerInstance(podName, leaderIdentity string) string {
+	if podName == "" && leaderIdentity == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", podName, leaderIdentity)
+}
+
+// SetControllerInstance records this controller process's identity (pod name and
+// leader-election identity) so that subsequently emitted events carry it as their
+// Source.Host, enabling dashboards to group events by controller instance.
+func (e *EventRecorderAdapter) SetControllerInstance(podName, leaderIdentity string) {
+	e.controllerInstance = controllerInstance(podName, leaderIdentity)
+}
+
+// hostRewritingEventSink wraps a record.EventSink and stamps Source.Host with the current
+// value of host() on every Create, so that events emitted through the ordinary Eventf/Warnf
+// path (not just emitRelatedEvent) carry the controller instance identity. This is necessary
+// because client-go's EventRecorder fixes its EventSource once, at eventBroadcaster.NewRecorder
+// time, with no per-call way to override Source.Host - rewriting at the sink is the only point
+// downstream of the recorder where the final, possibly-later-set controller instance is known.
+type hostRewritingEventSink struct {
+	record.EventSink
+	host func() string
+}
+
+func (s *hostRewritingEventSink) Create(event *corev1.Event) (*corev1.Event, error) {
+	event.Source.Host = s.host()
+	return s.EventSink.Create(event)
+}
+
+func (s *hostRewritingEventSink) Update(event *corev1.Event) (*corev1.Event, error) {
+	event.Source.Host = s.host()
+	return s.EventSink.Update(event)
+}
+
+// emitRelatedEvent writes a corev1.Event directly via the Kubernetes API, bypassing the
+// client-go EventRecorder (which has no way to populate Related), so that events about a
+// rollout's child ReplicaSet/AnalysisRun/Service can be threaded back to the parent rollout.
+func (e *EventRecorderAdapter) emitRelatedEvent(object runtime.Object, related runtime.Object, eventType, reason, message string) {
+	if e.kubeclientset == nil || related == nil {
+		return
+	}
+
+	involvedRef, err := reference.GetReference(scheme.Scheme, withStableUID(object))
+	if err != nil {
+		log.Errorf("failed to build event reference for %T: %s", object, err.Error())
+		return
+	}
+	relatedRef, err := reference.GetReference(scheme.Scheme, withStableUID(related))
+	if err != nil {
+		log.Errorf("failed to build related event reference for %T: %s", related, err.Error())
+		return
+	}
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: reason + "-",
+			Namespace:    involvedRef.Namespace,
+		},
+		InvolvedObject: *involvedRef,
+		Related:        relatedRef,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: controllerAgentName, Host: e.controllerInstance},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := e.kubeclientset.CoreV1().Events(involvedRef.Namespace).Create(context.Background(), event, metav1.CreateOptions{}); err != nil {
+		log.Errorf("failed to create related event: %s", err.Error())
+	}
+}
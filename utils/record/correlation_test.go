@@ -0,0 +1,85 @@
+package record
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDeterministicUIDIsStable(t *testing.T) {
+	uid1 := deterministicUID("ReplicaSet", "default", "canary-abc123")
+	uid2 := deterministicUID("ReplicaSet", "default", "canary-abc123")
+	assert.Equal(t, uid1, uid2)
+
+	uidOtherName := deterministicUID("ReplicaSet", "default", "canary-def456")
+	assert.NotEqual(t, uid1, uidOtherName)
+}
+
+func TestWithStableUIDDerivesUIDWhenMissing(t *testing.T) {
+	rs := &appsv1.ReplicaSet{
+		TypeMeta:   metav1.TypeMeta{Kind: "ReplicaSet"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "canary-abc123"},
+	}
+
+	stable := withStableUID(rs)
+
+	accessor := stable.(metav1.Object)
+	assert.NotEmpty(t, accessor.GetUID())
+	assert.Equal(t, deterministicUID("ReplicaSet", "default", "canary-abc123"), accessor.GetUID())
+	// the original object passed in is untouched
+	assert.Empty(t, rs.GetUID())
+}
+
+func TestWithStableUIDPreservesExistingUID(t *testing.T) {
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "canary-abc123", UID: "real-uid"}}
+
+	stable := withStableUID(rs)
+
+	accessor := stable.(metav1.Object)
+	assert.Equal(t, "real-uid", string(accessor.GetUID()))
+}
+
+func TestControllerInstance(t *testing.T) {
+	assert.Equal(t, "", controllerInstance("", ""))
+	assert.Equal(t, "rollouts-controller-0/leader-abc", controllerInstance("rollouts-controller-0", "leader-abc"))
+}
+
+// TestEventSourceHostReflectsControllerInstance exercises a real event emitted through
+// Eventf (not just the pure controllerInstance helper) to make sure SetControllerInstance
+// actually reaches Source.Host on the ordinary event path, not only emitRelatedEvent.
+func TestEventSourceHostReflectsControllerInstance(t *testing.T) {
+	kubeclientset := k8sfake.NewSimpleClientset()
+	rolloutEventCounter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "test_rollout_events_total"},
+		[]string{"name", "namespace", "type", "reason"},
+	)
+	recorder := NewEventRecorder(kubeclientset, rolloutEventCounter, nil).(*EventRecorderAdapter)
+	recorder.SetControllerInstance("rollouts-controller-0", "leader-abc")
+
+	rs := &appsv1.ReplicaSet{
+		TypeMeta:   metav1.TypeMeta{Kind: "ReplicaSet"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "canary-abc123"},
+	}
+	recorder.Eventf(rs, EventOptions{EventReason: "RolloutStepCompleted"}, "step completed")
+
+	var events []corev1.Event
+	for i := 0; i < 100; i++ {
+		list, err := kubeclientset.CoreV1().Events("default").List(context.Background(), metav1.ListOptions{})
+		require.NoError(t, err)
+		if len(list.Items) > 0 {
+			events = list.Items
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Len(t, events, 1)
+	assert.Equal(t, "rollouts-controller-0/leader-abc", events[0].Source.Host)
+}
@@ -0,0 +1,179 @@
+package record
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// DefaultDispatcherQueueSize is the default bound on the number of pending notification
+	// deliveries an EventRecorderAdapter will hold before dropping new events.
+	DefaultDispatcherQueueSize = 1000
+	// DefaultDispatcherWorkers is the default number of goroutines draining the notification
+	// queue.
+	DefaultDispatcherWorkers = 4
+)
+
+// DispatcherConfig controls the background dispatcher that delivers notifications
+// asynchronously from the goroutine that called Eventf/Warnf. It is typically populated
+// from controller flags.
+type DispatcherConfig struct {
+	// QueueSize is the number of pending event descriptors the dispatcher will buffer before
+	// dropping new events. Defaults to DefaultDispatcherQueueSize.
+	QueueSize int
+	// Workers is the number of goroutines draining the queue. Defaults to DefaultDispatcherWorkers.
+	Workers int
+	// CoalesceWindow, if non-zero, suppresses duplicate (object, reason) events fired within
+	// this duration of a previously enqueued one.
+	CoalesceWindow time.Duration
+}
+
+func (c DispatcherConfig) withDefaults() DispatcherConfig {
+	if c.QueueSize <= 0 {
+		c.QueueSize = DefaultDispatcherQueueSize
+	}
+	if c.Workers <= 0 {
+		c.Workers = DefaultDispatcherWorkers
+	}
+	return c
+}
+
+// notificationEvent is a snapshot of everything a dispatcher worker needs to deliver a
+// notification, captured on the caller's goroutine so the worker never touches mutable
+// state owned by the reconciler.
+type notificationEvent struct {
+	object      runtime.Object
+	opts        EventOptions
+	annotations map[string]string
+	message     string
+	enqueuedAt  time.Time
+}
+
+func (n notificationEvent) coalesceKey() string {
+	kind, namespace, name := objectRefParts(n.object)
+	return fmt.Sprintf("%s/%s/%s/%s", kind, namespace, name, n.opts.EventReason)
+}
+
+// notificationDispatcher is a bounded worker pool that decouples notification delivery
+// (JSON marshalling, template lookup, notificationsAPI.Send) from the caller's goroutine.
+type notificationDispatcher struct {
+	cfg     DispatcherConfig
+	adapter *EventRecorderAdapter
+	queue   chan notificationEvent
+
+	droppedCounter *prometheus.CounterVec
+	queueDepth     prometheus.Gauge
+	sendLatency    prometheus.Histogram
+
+	coalesceLock sync.Mutex
+	lastSeen     map[string]time.Time
+
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+func newNotificationDispatcher(adapter *EventRecorderAdapter, cfg DispatcherConfig, droppedCounter *prometheus.CounterVec, queueDepth prometheus.Gauge, sendLatency prometheus.Histogram) *notificationDispatcher {
+	cfg = cfg.withDefaults()
+	d := &notificationDispatcher{
+		cfg:            cfg,
+		adapter:        adapter,
+		queue:          make(chan notificationEvent, cfg.QueueSize),
+		droppedCounter: droppedCounter,
+		queueDepth:     queueDepth,
+		sendLatency:    sendLatency,
+		lastSeen:       make(map[string]time.Time),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return d
+}
+
+// enqueue buffers ev for delivery by a worker. If the queue is full the event is dropped
+// and rollout_notifications_dropped_total{reason="queue_full"} is incremented. If ev
+// duplicates one enqueued within the configured coalesce window, it is silently merged and
+// rollout_notifications_dropped_total{reason="coalesced"} is incremented instead. An event
+// enqueued after Close is dropped with rollout_notifications_dropped_total{reason="closed"}.
+func (d *notificationDispatcher) enqueue(ev notificationEvent) {
+	defer func() {
+		// Sending on the queue Close has closed panics; treat it as a drop.
+		if recover() != nil {
+			d.dropWithMetric("closed")
+		}
+	}()
+	if d.cfg.CoalesceWindow > 0 && d.shouldCoalesce(ev) {
+		d.dropWithMetric("coalesced")
+		return
+	}
+
+	select {
+	case d.queue <- ev:
+		if d.queueDepth != nil {
+			d.queueDepth.Set(float64(len(d.queue)))
+		}
+	default:
+		d.dropWithMetric("queue_full")
+	}
+}
+
+func (d *notificationDispatcher) dropWithMetric(reason string) {
+	if d.droppedCounter != nil {
+		d.droppedCounter.WithLabelValues(reason).Inc()
+	}
+}
+
+func (d *notificationDispatcher) shouldCoalesce(ev notificationEvent) bool {
+	key := ev.coalesceKey()
+	now := time.Now()
+
+	d.coalesceLock.Lock()
+	defer d.coalesceLock.Unlock()
+	if last, ok := d.lastSeen[key]; ok && now.Sub(last) < d.cfg.CoalesceWindow {
+		return true
+	}
+	d.lastSeen[key] = now
+	return false
+}
+
+func (d *notificationDispatcher) worker() {
+	defer d.wg.Done()
+	for ev := range d.queue {
+		if d.queueDepth != nil {
+			d.queueDepth.Set(float64(len(d.queue)))
+		}
+		start := time.Now()
+		if err := d.adapter.sendNotificationsForAnnotations(ev.object, ev.opts, ev.annotations); err != nil {
+			log.Errorf("notification dispatch error: %s", err.Error())
+		}
+		if d.sendLatency != nil {
+			d.sendLatency.Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+// Close stops accepting new events and waits for in-flight deliveries to drain, up to ctx's
+// deadline.
+func (d *notificationDispatcher) Close(ctx context.Context) error {
+	var err error
+	d.stopOnce.Do(func() {
+		close(d.queue)
+		done := make(chan struct{})
+		go func() {
+			d.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	})
+	return err
+}
@@ -0,0 +1,135 @@
+package record
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	rolloutsv1alpha1 "github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+)
+
+// newTestAdapter returns an adapter whose sendNotificationsForAnnotations is a no-op: the event
+// reason passed to enqueued notificationEvents is never a key in EventReasonToTrigger, so
+// matchingTriggers returns nothing and the dispatcher worker never touches apiFactory.
+func newTestAdapter() *EventRecorderAdapter {
+	return &EventRecorderAdapter{}
+}
+
+func testEvent(name string) notificationEvent {
+	return notificationEvent{
+		object:     &rolloutsv1alpha1.Rollout{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}},
+		opts:       EventOptions{EventReason: "NotABuiltInTrigger"},
+		enqueuedAt: time.Now(),
+	}
+}
+
+func TestDispatcherDeliversEnqueuedEvent(t *testing.T) {
+	d := newNotificationDispatcher(newTestAdapter(), DispatcherConfig{QueueSize: 1, Workers: 1}, nil, nil, nil)
+	d.enqueue(testEvent("a"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, d.Close(ctx))
+}
+
+// newIdleDispatcher builds a dispatcher with no worker goroutines draining its queue, so
+// enqueue's drop/coalesce bookkeeping can be asserted deterministically.
+func newIdleDispatcher(cfg DispatcherConfig, droppedCounter *prometheus.CounterVec) *notificationDispatcher {
+	cfg = cfg.withDefaults()
+	return &notificationDispatcher{
+		cfg:            cfg,
+		adapter:        newTestAdapter(),
+		queue:          make(chan notificationEvent, cfg.QueueSize),
+		droppedCounter: droppedCounter,
+		lastSeen:       make(map[string]time.Time),
+	}
+}
+
+func TestDispatcherDropsWhenQueueFull(t *testing.T) {
+	dropped := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_dropped_total"}, []string{"reason"})
+	d := newIdleDispatcher(DispatcherConfig{QueueSize: 1}, dropped)
+
+	d.enqueue(testEvent("a"))
+	d.enqueue(testEvent("b"))
+
+	assert.Equal(t, 1, len(d.queue))
+	assert.Equal(t, float64(1), testutilCounterValue(dropped, "queue_full"))
+}
+
+func TestDispatcherCoalescesDuplicatesWithinWindow(t *testing.T) {
+	dropped := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_dropped_total_2"}, []string{"reason"})
+	d := newIdleDispatcher(DispatcherConfig{QueueSize: 10, CoalesceWindow: time.Minute}, dropped)
+
+	ev := testEvent("a")
+	d.enqueue(ev)
+	d.enqueue(ev)
+
+	assert.Equal(t, 1, len(d.queue))
+	assert.Equal(t, float64(1), testutilCounterValue(dropped, "coalesced"))
+}
+
+func TestDispatcherCloseIsIdempotent(t *testing.T) {
+	d := newNotificationDispatcher(newTestAdapter(), DispatcherConfig{}, nil, nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, d.Close(ctx))
+	require.NoError(t, d.Close(ctx))
+}
+
+// TestConfigureDispatcherConcurrentWithEventf exercises e.dispatcher under -race: one goroutine
+// repeatedly reconfigures the dispatcher while others concurrently enqueue through Eventf, so a
+// regression back to an unguarded pointer field is caught by the race detector.
+func TestConfigureDispatcherConcurrentWithEventf(t *testing.T) {
+	adapter := NewFakeEventRecorder().(*EventRecorderAdapter)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			adapter.ConfigureDispatcher(DispatcherConfig{QueueSize: 10, Workers: 1}, nil, nil, nil)
+		}
+		close(stop)
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					adapter.Eventf(&rolloutsv1alpha1.Rollout{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "r"}}, EventOptions{EventReason: "NotABuiltInTrigger"}, "msg %d", i)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, adapter.Close(ctx))
+}
+
+// testutilCounterValue reads the current value of a single-label prometheus counter, avoiding a
+// dependency on the (heavier) prometheus/client_golang/prometheus/testutil package for this one
+// assertion.
+func testutilCounterValue(vec *prometheus.CounterVec, label string) float64 {
+	m := &dto.Metric{}
+	if err := vec.WithLabelValues(label).Write(m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
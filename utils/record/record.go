@@ -1,7 +1,11 @@
 package record
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/argoproj/notifications-engine/pkg/services"
 
@@ -13,6 +17,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/kubernetes"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
@@ -44,6 +49,11 @@ type EventOptions struct {
 	// capital letter). "reason" will be used to automate handling of events, so imagine people
 	// writing switch statements to handle them.
 	EventReason string
+	// RelatedObject, if set, is threaded back into the emitted event's `related` field so
+	// that events about a rollout's child ReplicaSet, AnalysisRun, or Service can be
+	// correlated with the parent rollout (e.g. "all events for rollout X across its child
+	// resources").
+	RelatedObject runtime.Object
 }
 
 type EventRecorder interface {
@@ -58,26 +68,178 @@ type EventRecorderAdapter struct {
 	Recorder record.EventRecorder
 	// RolloutEventCounter is a counter to increment on events
 	RolloutEventCounter *prometheus.CounterVec
+	// CloudEventDeliveryCounter is a counter incremented for every CloudEvents sink delivery
+	// attempt, labeled by sink name and result (success, error, circuit_open, dropped)
+	CloudEventDeliveryCounter *prometheus.CounterVec
 
 	// apiFactory is a notifications engine API factory
 	apiFactory api.Factory
+
+	cloudEventSinksLock sync.RWMutex
+	cloudEventSinks     []CloudEventSink
+	cloudEventBreakers  map[string]*cloudEventsCircuitBreaker
+
+	// cloudEventDispatcherLock guards cloudEventDispatcher the same way dispatcherLock guards
+	// dispatcher.
+	cloudEventDispatcherLock sync.RWMutex
+	// cloudEventDispatcher delivers CloudEvents on background workers so Eventf/Warnf never
+	// spawn an unbounded goroutine per sink per event.
+	cloudEventDispatcher *cloudEventDispatcher
+
+	// dispatcherLock guards dispatcher the same way cloudEventSinksLock/triggerRegistryLock
+	// guard their fields: ConfigureDispatcher replaces it from whatever goroutine handles
+	// ConfigMap reloads while eventf (reconciler goroutines) and Close read it concurrently.
+	dispatcherLock sync.RWMutex
+	// dispatcher delivers notifications on background workers so Eventf/Warnf never block
+	// the caller on notificationsAPI.Send
+	dispatcher *notificationDispatcher
+
+	triggerRegistryLock sync.RWMutex
+	triggerRegistry     *TriggerRegistry
+
+	// kubeclientset is retained so related events (see EventOptions.RelatedObject) can be
+	// written directly, since client-go's EventRecorder interface has no way to populate
+	// corev1.Event's Related field.
+	kubeclientset kubernetes.Interface
+	// controllerInstance identifies this controller process (pod name + leader-election
+	// identity) and is surfaced as Source.Host on every emitted event.
+	controllerInstance string
+
+	// retryPolicy controls delivery retries of notificationsAPI.Send. Defaults to
+	// DefaultRetryPolicy when unset.
+	retryPolicy RetryPolicy
+	// deadLetterStore receives deliveries that exhaust retryPolicy.MaxAttempts. Nil disables
+	// dead-lettering (the last error is simply returned/logged).
+	deadLetterStore DeadLetterStore
+	// deliveryLog records the idempotency key of every delivery that has already succeeded, so
+	// a retry replayed after a controller restart can be skipped instead of double-notifying.
+	// Nil disables the check (retries can always double-notify).
+	deliveryLog DeliveryLog
+}
+
+// SetTriggerRegistry installs registry as the source of user-defined triggers evaluated by
+// sendNotificationsForAnnotations in addition to the built-in, reason-keyed triggers. Callers
+// typically reload and call this whenever the notifications ConfigMap changes.
+func (e *EventRecorderAdapter) SetTriggerRegistry(registry *TriggerRegistry) {
+	e.triggerRegistryLock.Lock()
+	defer e.triggerRegistryLock.Unlock()
+	e.triggerRegistry = registry
+}
+
+func (e *EventRecorderAdapter) getTriggerRegistry() *TriggerRegistry {
+	e.triggerRegistryLock.RLock()
+	defer e.triggerRegistryLock.RUnlock()
+	return e.triggerRegistry
 }
 
 func NewEventRecorder(kubeclientset kubernetes.Interface, rolloutEventCounter *prometheus.CounterVec, apiFactory api.Factory) EventRecorder {
+	adapter := &EventRecorderAdapter{
+		RolloutEventCounter: rolloutEventCounter,
+		apiFactory:          apiFactory,
+		kubeclientset:       kubeclientset,
+	}
+
 	// Create event broadcaster
 	// Add argo-rollouts custom resources to the default Kubernetes Scheme so Events can be
 	// logged for argo-rollouts types.
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(log.Infof)
-	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
-	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
-	return &EventRecorderAdapter{
-		Recorder:            recorder,
-		RolloutEventCounter: rolloutEventCounter,
-		apiFactory:          apiFactory,
+	// Wrapped so that e.controllerInstance (set later, via SetControllerInstance) is stamped as
+	// Source.Host on every event recorded through adapter.Recorder, not just the ones written
+	// directly by emitRelatedEvent.
+	eventBroadcaster.StartRecordingToSink(&hostRewritingEventSink{
+		EventSink: &typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")},
+		host:      func() string { return adapter.controllerInstance },
+	})
+	adapter.Recorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
+	adapter.setDispatcher(newNotificationDispatcher(adapter, DispatcherConfig{}, nil, nil, nil))
+	adapter.setCloudEventDispatcher(newCloudEventDispatcher(adapter, 0, 0))
+	return adapter
+}
+
+// getCloudEventDispatcher returns the current CloudEvents dispatcher. It is safe to call
+// concurrently with ConfigureCloudEventDispatcher.
+func (e *EventRecorderAdapter) getCloudEventDispatcher() *cloudEventDispatcher {
+	e.cloudEventDispatcherLock.RLock()
+	defer e.cloudEventDispatcherLock.RUnlock()
+	return e.cloudEventDispatcher
+}
+
+func (e *EventRecorderAdapter) setCloudEventDispatcher(d *cloudEventDispatcher) {
+	e.cloudEventDispatcherLock.Lock()
+	defer e.cloudEventDispatcherLock.Unlock()
+	e.cloudEventDispatcher = d
+}
+
+// ConfigureCloudEventDispatcher replaces the background CloudEvents dispatcher with one sized
+// from queueSize/workers (0 for either uses DefaultCloudEventQueueSize/DefaultCloudEventWorkers),
+// typically called once at controller startup after flags have been parsed. The new dispatcher
+// takes over first; the previous one is then closed, its workers delivering whatever was already
+// queued on it before they exit (waiting up to 5s), so reconfiguring never leaks worker goroutines.
+func (e *EventRecorderAdapter) ConfigureCloudEventDispatcher(queueSize, workers int) {
+	previous := e.getCloudEventDispatcher()
+	e.setCloudEventDispatcher(newCloudEventDispatcher(e, queueSize, workers))
+	if previous != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := previous.Close(ctx); err != nil {
+			log.Errorf("failed to cleanly stop previous cloudevents dispatcher: %s", err.Error())
+		}
+	}
+}
+
+// getDispatcher returns the current notification dispatcher. It is safe to call concurrently
+// with ConfigureDispatcher.
+func (e *EventRecorderAdapter) getDispatcher() *notificationDispatcher {
+	e.dispatcherLock.RLock()
+	defer e.dispatcherLock.RUnlock()
+	return e.dispatcher
+}
+
+func (e *EventRecorderAdapter) setDispatcher(d *notificationDispatcher) {
+	e.dispatcherLock.Lock()
+	defer e.dispatcherLock.Unlock()
+	e.dispatcher = d
+}
+
+// ConfigureDispatcher replaces the background notification dispatcher with one built from
+// cfg and the given metrics, typically called once at controller startup after flags have
+// been parsed. The new dispatcher takes over first; the previous one is then closed, its workers
+// delivering whatever was already queued on it before they exit (waiting up to 5s), so
+// reconfiguring never leaks worker goroutines.
+func (e *EventRecorderAdapter) ConfigureDispatcher(cfg DispatcherConfig, droppedCounter *prometheus.CounterVec, queueDepth prometheus.Gauge, sendLatency prometheus.Histogram) {
+	previous := e.getDispatcher()
+	e.setDispatcher(newNotificationDispatcher(e, cfg, droppedCounter, queueDepth, sendLatency))
+	if previous != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := previous.Close(ctx); err != nil {
+			log.Errorf("failed to cleanly stop previous notification dispatcher: %s", err.Error())
+		}
 	}
 }
 
+// Close stops the background notification and CloudEvents dispatchers, waiting for in-flight
+// deliveries to drain until ctx is done.
+func (e *EventRecorderAdapter) Close(ctx context.Context) error {
+	err := e.getDispatcher().Close(ctx)
+	if cloudErr := e.getCloudEventDispatcher().Close(ctx); err == nil {
+		err = cloudErr
+	}
+	return err
+}
+
+// NewEventRecorderWithCloudEvents constructs an EventRecorder that, in addition to recording
+// Kubernetes events and notifications-engine notifications, dual-emits CloudEvents v1.0
+// payloads to the given sinks for every triggered BuiltInTriggers reason. cloudEventCounter
+// is incremented on every delivery attempt, labeled by sink name and result.
+func NewEventRecorderWithCloudEvents(kubeclientset kubernetes.Interface, rolloutEventCounter *prometheus.CounterVec, apiFactory api.Factory, cloudEventSinks []CloudEventSink, cloudEventCounter *prometheus.CounterVec) EventRecorder {
+	adapter := NewEventRecorder(kubeclientset, rolloutEventCounter, apiFactory).(*EventRecorderAdapter)
+	adapter.CloudEventDeliveryCounter = cloudEventCounter
+	adapter.SetCloudEventSinks(cloudEventSinks)
+	return adapter
+}
+
 func NewFakeEventRecorder() EventRecorder {
 	return NewEventRecorder(
 		k8sfake.NewSimpleClientset(),
@@ -108,13 +270,20 @@ func (e *EventRecorderAdapter) eventf(object runtime.Object, warn bool, opts Eve
 
 	if opts.EventReason != "" {
 		logCtx = logCtx.WithField("event_reason", opts.EventReason)
-		e.Recorder.Eventf(object, opts.EventType, opts.EventReason, messageFmt, args...)
+		// Ensure InvolvedObject.UID is always populated with a stable value (falling back to
+		// a UID derived from kind/namespace/name when the object has none) so the event
+		// aggregator and downstream correlation queries can group repeated events.
+		e.Recorder.Eventf(withStableUID(object), opts.EventType, opts.EventReason, messageFmt, args...)
 
 		// Increment rollout_events_total counter
 		kind, namespace, name := logutil.KindNamespaceName(logCtx)
 		if kind == "Rollout" {
 			e.RolloutEventCounter.WithLabelValues(namespace, name, opts.EventType, opts.EventReason).Inc()
 		}
+
+		if opts.RelatedObject != nil {
+			e.emitRelatedEvent(object, opts.RelatedObject, opts.EventType, opts.EventReason, fmt.Sprintf(messageFmt, args...))
+		}
 	}
 
 	logFn := logCtx.Infof
@@ -122,6 +291,23 @@ func (e *EventRecorderAdapter) eventf(object runtime.Object, warn bool, opts Eve
 		logFn = logCtx.Warnf
 	}
 	logFn(messageFmt, args...)
+
+	e.sendCloudEvents(object, opts, messageFmt, args)
+
+	if opts.EventReason != "" {
+		snapshot := object.DeepCopyObject()
+		var annotations map[string]string
+		if accessor, ok := snapshot.(metav1.Object); ok {
+			annotations = accessor.GetAnnotations()
+		}
+		e.getDispatcher().enqueue(notificationEvent{
+			object:      snapshot,
+			opts:        opts,
+			annotations: annotations,
+			message:     fmt.Sprintf(messageFmt, args...),
+			enqueuedAt:  time.Now(),
+		})
+	}
 }
 
 func (e *EventRecorderAdapter) K8sRecorder() record.EventRecorder {
@@ -150,18 +336,22 @@ func NewAPIFactorySettings() api.Settings {
 	}
 }
 
-// Send notifications for triggered event if user is subscribed
-func (e *EventRecorderAdapter) sendNotifications(object runtime.Object, opts EventOptions) error {
-	subsFromAnnotations := subscriptions.Annotations(object.(metav1.Object).GetAnnotations())
+// sendNotificationsForAnnotations delivers notifications-engine notifications for object/opts. It runs on
+// a dispatcher worker goroutine, not the caller of Eventf/Warnf, so annotations are passed in
+// as a snapshot taken at enqueue time rather than re-read from object.
+func (e *EventRecorderAdapter) sendNotificationsForAnnotations(object runtime.Object, opts EventOptions, annotations map[string]string) error {
+	subsFromAnnotations := subscriptions.Annotations(annotations)
 	destByTrigger := subsFromAnnotations.GetDestinations(nil, map[string][]string{})
 
-	trigger, ok := EventReasonToTrigger[opts.EventReason]
-	if !ok {
-		return nil
+	triggers := e.matchingTriggers(object, opts.EventReason)
+	subscribed := false
+	for _, trigger := range triggers {
+		if len(destByTrigger[trigger]) > 0 {
+			subscribed = true
+			break
+		}
 	}
-
-	destinations := destByTrigger[trigger]
-	if len(destinations) == 0 {
+	if !subscribed {
 		return nil
 	}
 
@@ -170,37 +360,74 @@ func (e *EventRecorderAdapter) sendNotifications(object runtime.Object, opts Eve
 		return err
 	}
 
-	// Creates config for notifications for built-in triggers
+	// Creates config for notifications for built-in and user-registered triggers
 	templates := map[string][]string{}
-	for name, triggers := range notificationsAPI.GetConfig().Triggers {
-		if _, ok := BuiltInTriggers[name]; ok {
-			templates[name] = triggers[0].Send
+	for name, triggerDefs := range notificationsAPI.GetConfig().Triggers {
+		if len(triggerDefs) > 0 {
+			templates[name] = triggerDefs[0].Send
 		}
 	}
 
-	objBytes, err := json.Marshal(object)
+	objMap, err := toObjectMap(object)
 	if err != nil {
 		return err
 	}
-	var objMap map[string]interface{}
-	err = json.Unmarshal(objBytes, &objMap)
-	if err != nil {
-		return err
+
+	var rolloutUID types.UID
+	var resourceVersion string
+	if accessor, ok := object.(metav1.Object); ok {
+		rolloutUID = accessor.GetUID()
+		resourceVersion = accessor.GetResourceVersion()
 	}
-	for _, dest := range destinations {
-		err = notificationsAPI.Send(objMap, templates[trigger], dest)
-		if err != nil {
-			log.Errorf("notification error: %s", err.Error())
-			return err
+
+	var lastErr error
+	for _, trigger := range triggers {
+		for _, dest := range destByTrigger[trigger] {
+			key := idempotencyKey(rolloutUID, resourceVersion, trigger+"/"+destKey(dest))
+			if err := e.sendWithRetry(notificationsAPI, objMap, templates[trigger], dest, trigger, key); err != nil {
+				log.Errorf("notification error: %s", err.Error())
+				lastErr = err
+			}
 		}
 	}
-	return nil
+	// A failing destination never short-circuits the others: every remaining trigger/destination
+	// for this event is still attempted even if an earlier one failed or is still retrying in
+	// the background. The last synchronous error, if any, is returned for logging/metrics only.
+	return lastErr
+}
+
+// matchingTriggers returns every trigger name activated by reason on object: the built-in
+// trigger keyed off EventReasonToTrigger, plus any user-registered trigger from the
+// EventRecorderAdapter's TriggerRegistry whose reasons or condition match.
+func (e *EventRecorderAdapter) matchingTriggers(object runtime.Object, reason string) []string {
+	var triggers []string
+	if trigger, ok := EventReasonToTrigger[reason]; ok {
+		triggers = append(triggers, trigger)
+	}
+	if registry := e.getTriggerRegistry(); registry != nil {
+		triggers = append(triggers, registry.TriggersMatching(object, reason)...)
+	}
+	return triggers
 }
 
 func (e *EventRecorderAdapter) GetAPIFactory() api.Factory {
 	return e.apiFactory
 }
 
+// toObjectMap round-trips object through JSON to produce the map[string]interface{}
+// representation notifications-engine templates and trigger expressions operate on.
+func toObjectMap(object runtime.Object) (map[string]interface{}, error) {
+	objBytes, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	var objMap map[string]interface{}
+	if err := json.Unmarshal(objBytes, &objMap); err != nil {
+		return nil, err
+	}
+	return objMap, nil
+}
+
 func reverseMap(m map[string]string) map[string]string {
 	n := make(map[string]string)
 	for k, v := range m {
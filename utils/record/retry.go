@@ -0,0 +1,430 @@
+package record
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"time"
+
+	"github.com/argoproj/notifications-engine/pkg/api"
+	"github.com/argoproj/notifications-engine/pkg/services"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// DeadLetterConfigMap is the ConfigMap NewConfigMapDeadLetterStore persists failed deliveries
+// to, keyed by idempotency key. No DeadLetterStore that posts to a sink URL is provided here;
+// any other store is installed with SetDeadLetterStore.
+const DeadLetterConfigMap = "argo-rollouts-notification-deadletter"
+
+// RetryPolicy configures how sendNotificationsForAnnotations retries a failed
+// notificationsAPI.Send call before giving up and writing the delivery to the dead-letter
+// store.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of delivery attempts, including the first. Defaults to 5.
+	MaxAttempts int
+	// InitialDelay is the delay before the first retry. Defaults to 1s.
+	InitialDelay time.Duration
+	// Multiplier scales InitialDelay on every subsequent attempt. Defaults to 2.0.
+	Multiplier float64
+	// Jitter is a fraction (0-1) of the computed delay randomly added or subtracted to avoid
+	// a thundering herd of retries. Defaults to 0.2.
+	Jitter float64
+	// MaxDelay caps the computed delay between attempts. Defaults to 1m.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used when an EventRecorderAdapter has no RetryPolicy configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  5,
+		InitialDelay: time.Second,
+		Multiplier:   2.0,
+		Jitter:       0.2,
+		MaxDelay:     time.Minute,
+	}
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryPolicy().MaxAttempts
+	}
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = DefaultRetryPolicy().InitialDelay
+	}
+	if p.Multiplier <= 0 {
+		p.Multiplier = DefaultRetryPolicy().Multiplier
+	}
+	if p.Jitter <= 0 {
+		p.Jitter = DefaultRetryPolicy().Jitter
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultRetryPolicy().MaxDelay
+	}
+	return p
+}
+
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := float64(p.InitialDelay) * pow(p.Multiplier, attempt)
+	if max := float64(p.MaxDelay); d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+func pow(base float64, exp int) float64 {
+	result := 1.0
+	for i := 0; i < exp; i++ {
+		result *= base
+	}
+	return result
+}
+
+// retryableErrorPatterns matches error messages indicating a transient failure worth retrying:
+// 5xx responses, rate limiting, and the usual network/timeout errors. None of the notifications-
+// engine services (webhook, slack, email, ...) wrap these in a typed error we could type-assert
+// on, so matching is done against err.Error() itself.
+var retryableErrorPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\b5\d{2}\b`),
+	regexp.MustCompile(`(?i)429|too many requests|rate limit`),
+	regexp.MustCompile(`(?i)timeout|timed out`),
+	regexp.MustCompile(`(?i)connection refused|connection reset|broken pipe|no such host|eof`),
+	regexp.MustCompile(`(?i)temporary|temporarily unavailable|service unavailable`),
+}
+
+// permanentErrorPatterns matches error messages that no amount of retrying will fix: bad
+// credentials/authentication and templates that fail to compile or render. These are the
+// specific failure modes the backlog called out as "permanent (4xx auth, invalid template)".
+var permanentErrorPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)unauthorized|unauthenticated|authentication failed|invalid credentials|invalid token|forbidden`),
+	regexp.MustCompile(`(?i)failed to compile|template:.*(parse error|undefined|not defined)|invalid template`),
+	regexp.MustCompile(`(?i)bad request`),
+	regexp.MustCompile(`\b4\d{2}\b`),
+}
+
+// classifyDeliveryError reports whether err is worth retrying. Transient failures
+// (retryableErrorPatterns) are always retryable even if they happen to also match a permanent
+// pattern; recognized permanent failures (permanentErrorPatterns) are not. Anything else
+// defaults to retryable, since the cost of a few extra attempts is far lower than silently
+// dead-lettering a transient error this classifier doesn't recognize.
+func classifyDeliveryError(err error) (retryable bool) {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, p := range retryableErrorPatterns {
+		if p.MatchString(msg) {
+			return true
+		}
+	}
+	for _, p := range permanentErrorPatterns {
+		if p.MatchString(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyKey derives a stable key, shared by every attempt, for a single delivery of
+// triggerAndDest (a trigger name and destKey, e.g. "on-completed/slack/bot") to a rollout at a
+// given resourceVersion, so retries after a controller restart can recognize a delivery that
+// already succeeded instead of double-notifying.
+func idempotencyKey(rolloutUID types.UID, resourceVersion, triggerAndDest string) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s/%s/%s", rolloutUID, resourceVersion, triggerAndDest)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// DeadLetterEntry is a single failed delivery persisted after RetryPolicy.MaxAttempts is
+// exhausted.
+type DeadLetterEntry struct {
+	IdempotencyKey string `json:"idempotencyKey"`
+	Trigger        string `json:"trigger"`
+	// Templates is the resolved list of template names (notificationsAPI.GetConfig().Triggers[Trigger][0].Send)
+	// that Replay must pass to notificationsAPI.Send. Trigger itself is not a template name and
+	// replaying with []string{Trigger} would look up a template that doesn't exist.
+	Templates   []string             `json:"templates"`
+	Destination services.Destination `json:"destination"`
+	Payload     json.RawMessage      `json:"payload"`
+	LastError   string               `json:"lastError"`
+	Timestamp   metav1.Time          `json:"timestamp"`
+}
+
+// DeadLetterStore persists deliveries that exhausted every retry attempt so an operator can
+// inspect or replay them later (see Replay).
+type DeadLetterStore interface {
+	Put(entry DeadLetterEntry) error
+	List() ([]DeadLetterEntry, error)
+	Delete(idempotencyKey string) error
+}
+
+// configMapDeadLetterStore is the default DeadLetterStore, persisting entries as JSON values
+// in a Kubernetes ConfigMap keyed by idempotency key.
+type configMapDeadLetterStore struct {
+	kubeclientset kubernetes.Interface
+	namespace     string
+	name          string
+}
+
+// NewConfigMapDeadLetterStore returns a DeadLetterStore backed by the
+// DeadLetterConfigMap ConfigMap in namespace.
+func NewConfigMapDeadLetterStore(kubeclientset kubernetes.Interface, namespace string) DeadLetterStore {
+	return &configMapDeadLetterStore{kubeclientset: kubeclientset, namespace: namespace, name: DeadLetterConfigMap}
+}
+
+// getOrCreateConfigMap fetches the named ConfigMap, creating an empty one if it doesn't yet
+// exist. It backs both configMapDeadLetterStore and configMapDeliveryLog.
+func getOrCreateConfigMap(ctx context.Context, kubeclientset kubernetes.Interface, namespace, name string) (*corev1.ConfigMap, error) {
+	cm, err := kubeclientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		return cm, nil
+	}
+	cm = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Data:       map[string]string{},
+	}
+	return kubeclientset.CoreV1().ConfigMaps(namespace).Create(ctx, cm, metav1.CreateOptions{})
+}
+
+func (s *configMapDeadLetterStore) Put(entry DeadLetterEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := getOrCreateConfigMap(ctx, s.kubeclientset, s.namespace, s.name)
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[entry.IdempotencyKey] = string(raw)
+		_, err = s.kubeclientset.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (s *configMapDeadLetterStore) List() ([]DeadLetterEntry, error) {
+	cm, err := s.kubeclientset.CoreV1().ConfigMaps(s.namespace).Get(context.Background(), s.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]DeadLetterEntry, 0, len(cm.Data))
+	for _, raw := range cm.Data {
+		var entry DeadLetterEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *configMapDeadLetterStore) Delete(idempotencyKey string) error {
+	ctx := context.Background()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := s.kubeclientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		delete(cm.Data, idempotencyKey)
+		_, err = s.kubeclientset.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// SetDeadLetterStore installs store as the destination for deliveries that exhaust
+// RetryPolicy.MaxAttempts or fail with a non-retryable error. If unset, such deliveries are
+// not dead-lettered.
+func (e *EventRecorderAdapter) SetDeadLetterStore(store DeadLetterStore) {
+	e.deadLetterStore = store
+}
+
+// SetRetryPolicy installs policy as the retry/backoff behavior for notification delivery.
+func (e *EventRecorderAdapter) SetRetryPolicy(policy RetryPolicy) {
+	e.retryPolicy = policy.withDefaults()
+}
+
+// SetDeliveryLog installs log as the record of deliveries that have already succeeded. When
+// set, sendWithRetry skips a delivery whose idempotency key is already recorded, so retries
+// replayed after a controller restart don't double-notify. If unset, no such check is made.
+func (e *EventRecorderAdapter) SetDeliveryLog(log DeliveryLog) {
+	e.deliveryLog = log
+}
+
+// sendWithRetry calls notificationsAPI.Send, skipping the call entirely if key is already
+// recorded in e.deliveryLog as delivered. Only the first attempt happens synchronously; if it
+// fails with a retryable error (per classifyDeliveryError), the remaining attempts from
+// e.retryPolicy run on their own goroutine with backoff between them, so one slow or failing
+// destination never blocks the dispatcher worker that's delivering every other
+// destination/trigger for the same event. A non-nil return means only that the first attempt
+// failed, not that retries are exhausted.
+func (e *EventRecorderAdapter) sendWithRetry(notificationsAPI api.API, objMap map[string]interface{}, templates []string, dest services.Destination, trigger, key string) error {
+	if e.deliveryLog != nil && e.deliveryLog.Seen(key) {
+		return nil
+	}
+
+	policy := e.retryPolicy.withDefaults()
+	err := notificationsAPI.Send(objMap, templates, dest)
+	if err == nil {
+		e.recordDelivered(key)
+		return nil
+	}
+	if classifyDeliveryError(err) && policy.MaxAttempts > 1 {
+		go e.retryInBackground(notificationsAPI, objMap, templates, dest, trigger, key, policy, err)
+	} else {
+		e.deadLetter(objMap, templates, dest, trigger, key, err)
+	}
+	return err
+}
+
+// retryInBackground runs the remaining attempts of policy after sendWithRetry's first attempt
+// failed with lastErr, sleeping between attempts on its own goroutine so it never blocks a
+// dispatcher worker. It writes the delivery to the dead-letter store if every attempt fails.
+func (e *EventRecorderAdapter) retryInBackground(notificationsAPI api.API, objMap map[string]interface{}, templates []string, dest services.Destination, trigger, key string, policy RetryPolicy, lastErr error) {
+	for attempt := 1; attempt < policy.MaxAttempts; attempt++ {
+		time.Sleep(policy.delay(attempt - 1))
+		lastErr = notificationsAPI.Send(objMap, templates, dest)
+		if lastErr == nil {
+			e.recordDelivered(key)
+			return
+		}
+		if !classifyDeliveryError(lastErr) {
+			break
+		}
+	}
+	e.deadLetter(objMap, templates, dest, trigger, key, lastErr)
+}
+
+func (e *EventRecorderAdapter) recordDelivered(key string) {
+	if e.deliveryLog == nil {
+		return
+	}
+	if err := e.deliveryLog.Record(key); err != nil {
+		log.Errorf("failed to record successful notification delivery %q: %s", key, err.Error())
+	}
+}
+
+func (e *EventRecorderAdapter) deadLetter(objMap map[string]interface{}, templates []string, dest services.Destination, trigger, key string, lastErr error) {
+	if e.deadLetterStore == nil {
+		return
+	}
+	payload, err := json.Marshal(objMap)
+	if err != nil {
+		payload = nil
+	}
+	if dlErr := e.deadLetterStore.Put(DeadLetterEntry{
+		IdempotencyKey: key,
+		Trigger:        trigger,
+		Templates:      templates,
+		Destination:    dest,
+		Payload:        payload,
+		LastError:      lastErr.Error(),
+		Timestamp:      metav1.Now(),
+	}); dlErr != nil {
+		log.Errorf("notification delivery failed (%s) and dead-letter write failed: %s", lastErr.Error(), dlErr.Error())
+	}
+}
+
+// DeliveryLog records the idempotency key of every notification delivery that has already
+// succeeded, so a retry replayed after a controller restart (see EventRecorderAdapter.SetDeliveryLog)
+// can be skipped instead of double-notifying.
+type DeliveryLog interface {
+	// Seen reports whether key has already been recorded as successfully delivered.
+	Seen(key string) bool
+	// Record marks key as successfully delivered.
+	Record(key string) error
+}
+
+// DeliveryLogConfigMap is the ConfigMap NewConfigMapDeliveryLog stores idempotency keys of
+// successful deliveries in, keyed by idempotency key.
+const DeliveryLogConfigMap = "argo-rollouts-notification-delivery-log"
+
+// deliveryLogEntryTTL bounds how long a delivered key is remembered, so the backing ConfigMap
+// doesn't grow without bound. It is well past the window in which a stuck retry or replay could
+// plausibly re-deliver the same event.
+const deliveryLogEntryTTL = 7 * 24 * time.Hour
+
+// configMapDeliveryLog is the default DeliveryLog, persisting delivered keys as RFC3339
+// timestamps in a Kubernetes ConfigMap.
+type configMapDeliveryLog struct {
+	kubeclientset kubernetes.Interface
+	namespace     string
+	name          string
+}
+
+// NewConfigMapDeliveryLog returns a DeliveryLog backed by the DeliveryLogConfigMap ConfigMap in
+// namespace.
+func NewConfigMapDeliveryLog(kubeclientset kubernetes.Interface, namespace string) DeliveryLog {
+	return &configMapDeliveryLog{kubeclientset: kubeclientset, namespace: namespace, name: DeliveryLogConfigMap}
+}
+
+func (s *configMapDeliveryLog) Seen(key string) bool {
+	cm, err := s.kubeclientset.CoreV1().ConfigMaps(s.namespace).Get(context.Background(), s.name, metav1.GetOptions{})
+	if err != nil {
+		return false
+	}
+	_, ok := cm.Data[key]
+	return ok
+}
+
+func (s *configMapDeliveryLog) Record(key string) error {
+	ctx := context.Background()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := getOrCreateConfigMap(ctx, s.kubeclientset, s.namespace, s.name)
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		now := time.Now()
+		cm.Data[key] = now.Format(time.RFC3339)
+		for k, v := range cm.Data {
+			if ts, err := time.Parse(time.RFC3339, v); err == nil && now.Sub(ts) > deliveryLogEntryTTL {
+				delete(cm.Data, k)
+			}
+		}
+		_, err = s.kubeclientset.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Replay re-attempts every entry in store through notificationsAPI, removing it from the
+// store on success. It backs the `kubectl argo rollouts notifications replay` subcommand.
+func Replay(store DeadLetterStore, notificationsAPI api.API) error {
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+	var replayErr error
+	for _, entry := range entries {
+		var objMap map[string]interface{}
+		if err := json.Unmarshal(entry.Payload, &objMap); err != nil {
+			replayErr = err
+			continue
+		}
+		if err := notificationsAPI.Send(objMap, entry.Templates, entry.Destination); err != nil {
+			replayErr = err
+			continue
+		}
+		if err := store.Delete(entry.IdempotencyKey); err != nil {
+			replayErr = err
+		}
+	}
+	return replayErr
+}
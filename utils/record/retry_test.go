@@ -0,0 +1,97 @@
+package record
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestClassifyDeliveryError(t *testing.T) {
+	assert.False(t, classifyDeliveryError(nil))
+	// Unrecognized error shapes default to retryable.
+	assert.True(t, classifyDeliveryError(assert.AnError))
+	assert.True(t, classifyDeliveryError(errors.New("500 Internal Server Error")))
+	assert.True(t, classifyDeliveryError(errors.New("429 Too Many Requests")))
+	assert.True(t, classifyDeliveryError(errors.New("dial tcp: connection refused")))
+	assert.True(t, classifyDeliveryError(errors.New("context deadline exceeded (Client.Timeout exceeded while awaiting headers)")))
+	assert.False(t, classifyDeliveryError(errors.New("400 Bad Request")))
+	assert.False(t, classifyDeliveryError(errors.New("401 Unauthorized: invalid token")))
+	assert.False(t, classifyDeliveryError(errors.New("failed to compile template \"on-completed-slack\": template: undefined field")))
+}
+
+func TestClassifyDeliveryErrorUnwrapsWrappedErrors(t *testing.T) {
+	wrapped := fmt.Errorf("sending: %w", errors.New("503 Service Unavailable"))
+	assert.True(t, classifyDeliveryError(wrapped))
+}
+
+func TestRetryPolicyWithDefaults(t *testing.T) {
+	policy := RetryPolicy{}.withDefaults()
+	assert.Equal(t, DefaultRetryPolicy(), policy)
+
+	custom := RetryPolicy{MaxAttempts: 2}.withDefaults()
+	assert.Equal(t, 2, custom.MaxAttempts)
+	assert.Equal(t, DefaultRetryPolicy().InitialDelay, custom.InitialDelay)
+}
+
+func TestRetryPolicyDelayIsBoundedByMaxDelay(t *testing.T) {
+	policy := RetryPolicy{InitialDelay: time.Second, Multiplier: 2, Jitter: 0, MaxDelay: 5 * time.Second}
+	assert.Equal(t, time.Second, policy.delay(0))
+	assert.Equal(t, 2*time.Second, policy.delay(1))
+	assert.Equal(t, 4*time.Second, policy.delay(2))
+	assert.Equal(t, 5*time.Second, policy.delay(3))
+}
+
+func TestRetryPolicyDelayJitterStaysNonNegative(t *testing.T) {
+	policy := RetryPolicy{InitialDelay: time.Millisecond, Multiplier: 2, Jitter: 1, MaxDelay: time.Second}
+	for i := 0; i < 100; i++ {
+		assert.GreaterOrEqual(t, policy.delay(0), time.Duration(0))
+	}
+}
+
+func TestIdempotencyKeyIsStableAndDistinguishesDestinations(t *testing.T) {
+	k1 := idempotencyKey("rollout-uid", "1", "on-completed/slack:bot")
+	k2 := idempotencyKey("rollout-uid", "1", "on-completed/slack:bot")
+	assert.Equal(t, k1, k2)
+
+	k3 := idempotencyKey("rollout-uid", "1", "on-completed/email:ops")
+	assert.NotEqual(t, k1, k3)
+}
+
+func TestConfigMapDeadLetterStoreRoundTrip(t *testing.T) {
+	kubeclientset := k8sfake.NewSimpleClientset()
+	store := NewConfigMapDeadLetterStore(kubeclientset, "argo-rollouts")
+
+	entry := DeadLetterEntry{
+		IdempotencyKey: "key-1",
+		Trigger:        "on-completed",
+		Templates:      []string{"on-completed-slack"},
+		LastError:      "boom",
+	}
+	require.NoError(t, store.Put(entry))
+
+	entries, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, entry.IdempotencyKey, entries[0].IdempotencyKey)
+	assert.Equal(t, entry.Templates, entries[0].Templates)
+
+	require.NoError(t, store.Delete("key-1"))
+	entries, err = store.List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestConfigMapDeliveryLogRoundTrip(t *testing.T) {
+	kubeclientset := k8sfake.NewSimpleClientset()
+	log := NewConfigMapDeliveryLog(kubeclientset, "argo-rollouts")
+
+	assert.False(t, log.Seen("key-1"))
+	require.NoError(t, log.Record("key-1"))
+	assert.True(t, log.Seen("key-1"))
+	assert.False(t, log.Seen("key-2"))
+}
@@ -0,0 +1,138 @@
+package record
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/antonmedv/expr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// customTriggersConfigMapKey is the key in the notifications ConfigMap that holds
+// user-defined triggers, serialized as YAML.
+const customTriggersConfigMapKey = "triggers.custom"
+
+// registeredTrigger is a single entry in a TriggerRegistry: a name, the Kubernetes event
+// reasons that activate it, and an optional condition evaluated against the rollout object
+// for triggers keyed on status rather than (or in addition to) a specific event reason.
+type registeredTrigger struct {
+	name      string
+	reasons   []string
+	condition func(obj runtime.Object) bool
+}
+
+// TriggerRegistry holds user-defined triggers on top of the hard-coded BuiltInTriggers, so
+// operators can wire destinations to custom Kubernetes event reasons or to arbitrary rollout
+// status conditions without recompiling the controller.
+type TriggerRegistry struct {
+	lock     sync.RWMutex
+	triggers []registeredTrigger
+}
+
+// NewTriggerRegistry returns an empty TriggerRegistry.
+func NewTriggerRegistry() *TriggerRegistry {
+	return &TriggerRegistry{}
+}
+
+// Register adds a trigger named name that is considered activated when either an event with
+// one of reasons is recorded, or (if condition is non-nil) condition(obj) returns true for the
+// object being evaluated.
+func (r *TriggerRegistry) Register(name string, reasons []string, condition func(obj runtime.Object) bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.triggers = append(r.triggers, registeredTrigger{name: name, reasons: reasons, condition: condition})
+}
+
+// TriggersMatching returns the names of every registered trigger activated by reason, or by
+// evaluating its condition (if any) against obj.
+func (r *TriggerRegistry) TriggersMatching(obj runtime.Object, reason string) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var matched []string
+	for _, t := range r.triggers {
+		if reasonMatches(t.reasons, reason) {
+			matched = append(matched, t.name)
+			continue
+		}
+		if t.condition != nil && t.condition(obj) {
+			matched = append(matched, t.name)
+		}
+	}
+	return matched
+}
+
+func reasonMatches(reasons []string, reason string) bool {
+	for _, r := range reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// customTrigger is the YAML shape of a single entry under the "triggers.custom" notifications
+// ConfigMap key.
+type customTrigger struct {
+	Name string `json:"name"`
+	// Reasons are Kubernetes event reasons that activate this trigger, in addition to (or
+	// instead of) evaluating When.
+	Reasons []string `json:"reasons,omitempty"`
+	// When is a notifications-engine expression evaluated against {"rollout": <object>},
+	// e.g. `rollout.status.phase == 'Degraded' && rollout.status.canary.currentStepIndex >= 3`.
+	When string `json:"when,omitempty"`
+}
+
+// LoadTriggerRegistry parses user-defined triggers out of the notifications ConfigMap and
+// compiles their `when` expressions using notifications-engine's expression language.
+func LoadTriggerRegistry(configMap *corev1.ConfigMap) (*TriggerRegistry, error) {
+	registry := NewTriggerRegistry()
+	if configMap == nil {
+		return registry, nil
+	}
+	raw, ok := configMap.Data[customTriggersConfigMapKey]
+	if !ok || raw == "" {
+		return registry, nil
+	}
+
+	var customTriggers []customTrigger
+	if err := yaml.Unmarshal([]byte(raw), &customTriggers); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", customTriggersConfigMapKey, err)
+	}
+
+	for _, t := range customTriggers {
+		condition, err := compileTriggerCondition(t.When)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile trigger %q: %w", t.Name, err)
+		}
+		registry.Register(t.Name, t.Reasons, condition)
+	}
+	return registry, nil
+}
+
+// compileTriggerCondition compiles a notifications-engine style boolean expression against
+// {"rollout": obj} into a condition func. A blank expression matches nothing by itself (the
+// trigger still activates via its Reasons).
+func compileTriggerCondition(expression string) (func(obj runtime.Object) bool, error) {
+	if expression == "" {
+		return nil, nil
+	}
+	program, err := expr.Compile(expression, expr.AllowUndefinedVariables())
+	if err != nil {
+		return nil, err
+	}
+	return func(obj runtime.Object) bool {
+		objMap, err := toObjectMap(obj)
+		if err != nil {
+			return false
+		}
+		out, err := expr.Run(program, map[string]interface{}{"rollout": objMap})
+		if err != nil {
+			return false
+		}
+		matched, _ := out.(bool)
+		return matched
+	}, nil
+}
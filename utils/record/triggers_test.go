@@ -0,0 +1,83 @@
+package record
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	rolloutsv1alpha1 "github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+)
+
+func TestTriggerRegistryMatchesByReason(t *testing.T) {
+	registry := NewTriggerRegistry()
+	registry.Register("on-degraded", []string{"RolloutDegraded"}, nil)
+
+	assert.Equal(t, []string{"on-degraded"}, registry.TriggersMatching(&rolloutsv1alpha1.Rollout{}, "RolloutDegraded"))
+	assert.Empty(t, registry.TriggersMatching(&rolloutsv1alpha1.Rollout{}, "RolloutCompleted"))
+}
+
+func TestTriggerRegistryTriggersMatchingCombinesReasonAndCondition(t *testing.T) {
+	registry := NewTriggerRegistry()
+	condition, err := compileTriggerCondition("rollout.status.phase == 'Degraded'")
+	require.NoError(t, err)
+	registry.Register("on-degraded-status", nil, condition)
+
+	degraded := &rolloutsv1alpha1.Rollout{Status: rolloutsv1alpha1.RolloutStatus{Phase: "Degraded"}}
+	healthy := &rolloutsv1alpha1.Rollout{Status: rolloutsv1alpha1.RolloutStatus{Phase: "Healthy"}}
+
+	assert.Equal(t, []string{"on-degraded-status"}, registry.TriggersMatching(degraded, ""))
+	assert.Empty(t, registry.TriggersMatching(healthy, ""))
+}
+
+func TestCompileTriggerConditionBlankExpressionIsNil(t *testing.T) {
+	condition, err := compileTriggerCondition("")
+	require.NoError(t, err)
+	assert.Nil(t, condition)
+}
+
+func TestCompileTriggerConditionInvalidExpression(t *testing.T) {
+	_, err := compileTriggerCondition("rollout.status.phase ==")
+	assert.Error(t, err)
+}
+
+func TestLoadTriggerRegistryFromConfigMap(t *testing.T) {
+	cm := &corev1.ConfigMap{Data: map[string]string{
+		customTriggersConfigMapKey: `
+- name: on-degraded
+  reasons:
+    - RolloutDegraded
+- name: on-degraded-status
+  when: "rollout.status.phase == 'Degraded'"
+`,
+	}}
+
+	registry, err := LoadTriggerRegistry(cm)
+	require.NoError(t, err)
+
+	degraded := &rolloutsv1alpha1.Rollout{
+		ObjectMeta: metav1.ObjectMeta{Name: "r"},
+		Status:     rolloutsv1alpha1.RolloutStatus{Phase: "Degraded"},
+	}
+	matched := registry.TriggersMatching(degraded, "RolloutDegraded")
+	assert.ElementsMatch(t, []string{"on-degraded", "on-degraded-status"}, matched)
+}
+
+func TestLoadTriggerRegistryNilConfigMap(t *testing.T) {
+	registry, err := LoadTriggerRegistry(nil)
+	require.NoError(t, err)
+	assert.Empty(t, registry.TriggersMatching(&rolloutsv1alpha1.Rollout{}, "anything"))
+}
+
+func TestLoadTriggerRegistryInvalidExpression(t *testing.T) {
+	cm := &corev1.ConfigMap{Data: map[string]string{
+		customTriggersConfigMapKey: `
+- name: broken
+  when: "rollout.status.phase =="
+`,
+	}}
+	_, err := LoadTriggerRegistry(cm)
+	assert.Error(t, err)
+}
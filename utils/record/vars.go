@@ -0,0 +1,360 @@
+package record
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/argoproj/notifications-engine/pkg/services"
+	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"sigs.k8s.io/yaml"
+
+	rolloutsv1alpha1 "github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+	rolloutslisters "github.com/argoproj/argo-rollouts/pkg/client/listers/rollouts/v1alpha1"
+	"github.com/argoproj/notifications-engine/pkg/api"
+)
+
+// TemplateVarsConfig wires the informers InitGetVars uses to lazily resolve objects related
+// to a rollout (its ReplicaSets, AnalysisRuns, Experiment, Services) into the notification
+// template context, plus static cluster metadata.
+type TemplateVarsConfig struct {
+	ReplicaSetLister  appslisters.ReplicaSetLister
+	ServiceLister     corelisters.ServiceLister
+	AnalysisRunLister rolloutslisters.AnalysisRunLister
+	ExperimentLister  rolloutslisters.ExperimentLister
+
+	// ClusterName and Environment are static cluster metadata, typically sourced from
+	// controller flags, surfaced to templates as `cluster.name`/`cluster.environment`.
+	ClusterName string
+	Environment string
+}
+
+// destinationFieldsConfigMapKey is the key in the notifications ConfigMap mapping a
+// destination (service/recipient) to the list of extra template variables it wants computed,
+// so heavy fields (e.g. analysisRuns) aren't fetched for destinations that don't use them.
+const destinationFieldsConfigMapKey = "context.fields"
+
+const (
+	varReplicaSets  = "replicaSets"
+	varAnalysisRuns = "analysisRuns"
+	varExperiment   = "experiment"
+	varService      = "service"
+	varCluster      = "cluster"
+)
+
+// allTemplateVarFields is used for destinations with no explicit "context.fields" entry, so
+// existing templates that rely on the full context keep working.
+var allTemplateVarFields = []string{varReplicaSets, varAnalysisRuns, varExperiment, varService, varCluster}
+
+// templateVarsCacheEntryTTL bounds how long a rollout's computed vars are kept once they stop
+// being accessed, so a cache created once for the lifetime of an api.Factory (see InitGetVars in
+// NewAPIFactorySettingsWithVars) doesn't grow without bound as rollouts are deleted or renamed.
+// Mirrors deliveryLogEntryTTL's opportunistic-prune-on-access pattern.
+const templateVarsCacheEntryTTL = time.Hour
+
+// templateVarsCache memoizes the expensive, lazily-computed variables for each rollout's
+// current resourceVersion, keyed by rollout identity so that concurrent dispatcher workers
+// computing vars for different rollouts never invalidate each other's cached entries, and a
+// send to N destinations for the same rollout update only resolves ReplicaSets/AnalysisRuns/etc.
+// once. Entries untouched for templateVarsCacheEntryTTL are pruned on the next get() call, so a
+// rollout that stops sending notifications (e.g. it was deleted) doesn't stay cached forever.
+type templateVarsCache struct {
+	lock    sync.Mutex
+	entries map[string]*rolloutVarsCacheEntry
+}
+
+// rolloutVarsCacheEntry holds the fields computed so far for a single rollout at a single
+// resourceVersion.
+type rolloutVarsCacheEntry struct {
+	resourceVersion string
+	computed        map[string]interface{}
+	lastAccessed    time.Time
+}
+
+func (c *templateVarsCache) get(rollout *rolloutsv1alpha1.Rollout, field string, compute func() interface{}) interface{} {
+	key := rolloutCacheKey(rollout)
+	now := time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]*rolloutVarsCacheEntry{}
+	}
+	c.evictStale(now)
+
+	entry, ok := c.entries[key]
+	if !ok || entry.resourceVersion != rollout.ResourceVersion {
+		entry = &rolloutVarsCacheEntry{resourceVersion: rollout.ResourceVersion, computed: map[string]interface{}{}}
+		c.entries[key] = entry
+	}
+	entry.lastAccessed = now
+	if v, ok := entry.computed[field]; ok {
+		return v
+	}
+	v := compute()
+	entry.computed[field] = v
+	return v
+}
+
+// evictStale removes every entry last accessed more than templateVarsCacheEntryTTL before now.
+// Callers must hold c.lock.
+func (c *templateVarsCache) evictStale(now time.Time) {
+	for key, entry := range c.entries {
+		if now.Sub(entry.lastAccessed) > templateVarsCacheEntryTTL {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// rolloutCacheKey identifies a rollout for templateVarsCache, preferring its UID (stable across
+// renames) and falling back to namespace/name if the UID isn't populated.
+func rolloutCacheKey(rollout *rolloutsv1alpha1.Rollout) string {
+	if rollout.UID != "" {
+		return string(rollout.UID)
+	}
+	return rollout.Namespace + "/" + rollout.Name
+}
+
+// replicaSetVars describes a single named ReplicaSet slot (stable/canary/preview/active) in
+// the notification template context.
+type replicaSetVars struct {
+	Name     string   `json:"name"`
+	Replicas int32    `json:"replicas"`
+	Ready    int32    `json:"readyReplicas"`
+	Images   []string `json:"images"`
+}
+
+func newReplicaSetVars(rs *appsv1.ReplicaSet) replicaSetVars {
+	if rs == nil {
+		return replicaSetVars{}
+	}
+	var images []string
+	for _, c := range rs.Spec.Template.Spec.Containers {
+		images = append(images, c.Image)
+	}
+	return replicaSetVars{
+		Name:     rs.Name,
+		Replicas: rs.Status.Replicas,
+		Ready:    rs.Status.ReadyReplicas,
+		Images:   images,
+	}
+}
+
+// buildReplicaSetVars resolves the stable/canary/preview/active ReplicaSets for rollout,
+// keyed by the pod-template-hash labels argo-rollouts stamps onto every ReplicaSet it owns.
+func buildReplicaSetVars(cfg *TemplateVarsConfig, rollout *rolloutsv1alpha1.Rollout) map[string]interface{} {
+	if cfg == nil || cfg.ReplicaSetLister == nil {
+		return nil
+	}
+	all, err := cfg.ReplicaSetLister.ReplicaSets(rollout.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	byHash := map[string]*appsv1.ReplicaSet{}
+	for _, rs := range all {
+		if !isOwnedByRollout(rs.OwnerReferences, rollout.Name) {
+			continue
+		}
+		if hash, ok := rs.Labels[rolloutsv1alpha1.DefaultRolloutUniqueLabelKey]; ok {
+			byHash[hash] = rs
+		}
+	}
+
+	result := map[string]interface{}{}
+	if rollout.Status.StableRS != "" {
+		result["stable"] = newReplicaSetVars(byHash[rollout.Status.StableRS])
+	}
+	if rollout.Status.CurrentPodHash != "" {
+		result["canary"] = newReplicaSetVars(byHash[rollout.Status.CurrentPodHash])
+	}
+	if rollout.Status.BlueGreen.PreviewSelector != "" {
+		result["preview"] = newReplicaSetVars(byHash[rollout.Status.BlueGreen.PreviewSelector])
+	}
+	if rollout.Status.BlueGreen.ActiveSelector != "" {
+		result["active"] = newReplicaSetVars(byHash[rollout.Status.BlueGreen.ActiveSelector])
+	}
+	return result
+}
+
+func isOwnedByRollout(refs []metav1.OwnerReference, rolloutName string) bool {
+	for _, ref := range refs {
+		if ref.Kind == "Rollout" && ref.Name == rolloutName {
+			return true
+		}
+	}
+	return false
+}
+
+// buildAnalysisRunVars resolves the AnalysisRuns owned by rollout, surfacing each run's phase
+// and latest measurement per metric.
+func buildAnalysisRunVars(cfg *TemplateVarsConfig, rollout *rolloutsv1alpha1.Rollout) []map[string]interface{} {
+	if cfg == nil || cfg.AnalysisRunLister == nil {
+		return nil
+	}
+	runs, err := cfg.AnalysisRunLister.AnalysisRuns(rollout.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	var vars []map[string]interface{}
+	for _, run := range runs {
+		if !isOwnedByRollout(run.OwnerReferences, rollout.Name) {
+			continue
+		}
+		measurements := map[string]interface{}{}
+		for _, mr := range run.Status.MetricResults {
+			if len(mr.Measurements) == 0 {
+				continue
+			}
+			measurements[mr.Name] = mr.Measurements[len(mr.Measurements)-1].Value
+		}
+		vars = append(vars, map[string]interface{}{
+			"name":         run.Name,
+			"phase":        string(run.Status.Phase),
+			"measurements": measurements,
+		})
+	}
+	return vars
+}
+
+// buildExperimentVars resolves the Experiment running rollout's current experiment step, if
+// any, surfacing its phase and the status of each of its templates.
+func buildExperimentVars(cfg *TemplateVarsConfig, rollout *rolloutsv1alpha1.Rollout) map[string]interface{} {
+	if cfg == nil || cfg.ExperimentLister == nil || rollout.Status.Canary.CurrentExperiment == "" {
+		return nil
+	}
+	exp, err := cfg.ExperimentLister.Experiments(rollout.Namespace).Get(rollout.Status.Canary.CurrentExperiment)
+	if err != nil {
+		return nil
+	}
+	templates := map[string]interface{}{}
+	for _, ts := range exp.Status.TemplateStatuses {
+		templates[ts.Name] = map[string]interface{}{"replicas": ts.Replicas, "readyReplicas": ts.ReadyReplicas}
+	}
+	return map[string]interface{}{
+		"name":      exp.Name,
+		"phase":     string(exp.Status.Phase),
+		"templates": templates,
+	}
+}
+
+// buildServiceVars resolves the stable/canary/active/preview Service mappings declared on the
+// rollout's strategy.
+func buildServiceVars(cfg *TemplateVarsConfig, rollout *rolloutsv1alpha1.Rollout) map[string]interface{} {
+	if cfg == nil || cfg.ServiceLister == nil {
+		return nil
+	}
+	names := map[string]string{}
+	if rollout.Spec.Strategy.Canary != nil {
+		names["stable"] = rollout.Spec.Strategy.Canary.StableService
+		names["canary"] = rollout.Spec.Strategy.Canary.CanaryService
+	}
+	if rollout.Spec.Strategy.BlueGreen != nil {
+		names["active"] = rollout.Spec.Strategy.BlueGreen.ActiveService
+		names["preview"] = rollout.Spec.Strategy.BlueGreen.PreviewService
+	}
+
+	result := map[string]interface{}{}
+	for role, name := range names {
+		if name == "" {
+			continue
+		}
+		svc, err := cfg.ServiceLister.Services(rollout.Namespace).Get(name)
+		if err != nil {
+			continue
+		}
+		result[role] = map[string]interface{}{"name": svc.Name}
+	}
+	return result
+}
+
+// NewAPIFactorySettingsWithVars is like NewAPIFactorySettings but expands the template
+// context InitGetVars exposes beyond `{"rollout": obj}` with the related objects a
+// notification recipient typically needs: replicaSets, analysisRuns, experiment, service, and
+// cluster metadata. Per-destination field selection is read from the "context.fields" key of the
+// notifications ConfigMap so heavy fields aren't computed for destinations that don't use
+// them.
+func NewAPIFactorySettingsWithVars(cfg *TemplateVarsConfig) api.Settings {
+	settings := NewAPIFactorySettings()
+	settings.InitGetVars = func(apiCfg *api.Config, configMap *corev1.ConfigMap, secret *corev1.Secret) (api.GetVars, error) {
+		destFields := parseDestinationFields(configMap)
+		cache := &templateVarsCache{}
+
+		return func(obj map[string]interface{}, dest services.Destination) map[string]interface{} {
+			vars := map[string]interface{}{"rollout": obj}
+
+			rollout, err := toRollout(obj)
+			if err != nil {
+				return vars
+			}
+			fields, ok := destFields[destKey(dest)]
+			if !ok {
+				fields = allTemplateVarFields
+			}
+
+			for _, field := range fields {
+				switch field {
+				case varReplicaSets:
+					vars[varReplicaSets] = cache.get(rollout, varReplicaSets, func() interface{} {
+						return buildReplicaSetVars(cfg, rollout)
+					})
+				case varAnalysisRuns:
+					vars[varAnalysisRuns] = cache.get(rollout, varAnalysisRuns, func() interface{} {
+						return buildAnalysisRunVars(cfg, rollout)
+					})
+				case varExperiment:
+					vars[varExperiment] = cache.get(rollout, varExperiment, func() interface{} {
+						return buildExperimentVars(cfg, rollout)
+					})
+				case varService:
+					vars[varService] = cache.get(rollout, varService, func() interface{} {
+						return buildServiceVars(cfg, rollout)
+					})
+				case varCluster:
+					vars[varCluster] = map[string]interface{}{"name": cfg.ClusterName, "environment": cfg.Environment}
+				}
+			}
+			return vars
+		}, nil
+	}
+	return settings
+}
+
+// toRollout converts the map[string]interface{} representation notifications-engine passes
+// to GetVars back into a typed Rollout so field lookups don't need repeated type assertions.
+func toRollout(obj map[string]interface{}) (*rolloutsv1alpha1.Rollout, error) {
+	objBytes, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	rollout := &rolloutsv1alpha1.Rollout{}
+	if err := json.Unmarshal(objBytes, rollout); err != nil {
+		return nil, err
+	}
+	return rollout, nil
+}
+
+func destKey(dest services.Destination) string {
+	return dest.Service + "/" + dest.Recipient
+}
+
+func parseDestinationFields(configMap *corev1.ConfigMap) map[string][]string {
+	result := map[string][]string{}
+	if configMap == nil {
+		return result
+	}
+	raw, ok := configMap.Data[destinationFieldsConfigMapKey]
+	if !ok || raw == "" {
+		return result
+	}
+	if err := yaml.Unmarshal([]byte(raw), &result); err != nil {
+		log.Errorf("failed to parse %s: %s", destinationFieldsConfigMapKey, err.Error())
+		return map[string][]string{}
+	}
+	return result
+}
@@ -0,0 +1,126 @@
+package record
+
+import (
+	"testing"
+	"time"
+
+	"github.com/argoproj/notifications-engine/pkg/services"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	rolloutsv1alpha1 "github.com/argoproj/argo-rollouts/pkg/apis/rollouts/v1alpha1"
+)
+
+func TestTemplateVarsCacheKeyedByRolloutIdentity(t *testing.T) {
+	cache := &templateVarsCache{}
+	rolloutA := &rolloutsv1alpha1.Rollout{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "a", UID: types.UID("uid-a"), ResourceVersion: "1"},
+	}
+	rolloutB := &rolloutsv1alpha1.Rollout{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "b", UID: types.UID("uid-b"), ResourceVersion: "1"},
+	}
+
+	calls := 0
+	compute := func() interface{} {
+		calls++
+		return calls
+	}
+
+	// Computing the same field for two different rollouts at the same resourceVersion must not
+	// thrash: each rollout gets its own cached value, computed exactly once.
+	valueA := cache.get(rolloutA, varReplicaSets, compute)
+	valueB := cache.get(rolloutB, varReplicaSets, compute)
+	assert.NotEqual(t, valueA, valueB)
+	assert.Equal(t, 2, calls)
+
+	// Repeating the lookup for rolloutA must hit the cache, not recompute.
+	again := cache.get(rolloutA, varReplicaSets, compute)
+	assert.Equal(t, valueA, again)
+	assert.Equal(t, 2, calls)
+}
+
+func TestTemplateVarsCacheInvalidatesOnResourceVersionChange(t *testing.T) {
+	cache := &templateVarsCache{}
+	rollout := &rolloutsv1alpha1.Rollout{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "a", UID: types.UID("uid-a"), ResourceVersion: "1"},
+	}
+
+	calls := 0
+	compute := func() interface{} {
+		calls++
+		return calls
+	}
+
+	cache.get(rollout, varReplicaSets, compute)
+	cache.get(rollout, varReplicaSets, compute)
+	assert.Equal(t, 1, calls)
+
+	rollout.ResourceVersion = "2"
+	cache.get(rollout, varReplicaSets, compute)
+	assert.Equal(t, 2, calls)
+}
+
+func TestTemplateVarsCacheEvictsStaleEntries(t *testing.T) {
+	cache := &templateVarsCache{}
+	rolloutA := &rolloutsv1alpha1.Rollout{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "a", UID: types.UID("uid-a"), ResourceVersion: "1"},
+	}
+	rolloutB := &rolloutsv1alpha1.Rollout{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "b", UID: types.UID("uid-b"), ResourceVersion: "1"},
+	}
+
+	cache.get(rolloutA, varReplicaSets, func() interface{} { return "a" })
+	require.Contains(t, cache.entries, rolloutCacheKey(rolloutA))
+
+	// Backdate rolloutA's entry past the TTL so the next get() (for an unrelated rollout) prunes
+	// it, simulating a rollout that was deleted and never sends another notification.
+	cache.entries[rolloutCacheKey(rolloutA)].lastAccessed = time.Now().Add(-templateVarsCacheEntryTTL - time.Minute)
+
+	cache.get(rolloutB, varReplicaSets, func() interface{} { return "b" })
+	assert.NotContains(t, cache.entries, rolloutCacheKey(rolloutA))
+	assert.Contains(t, cache.entries, rolloutCacheKey(rolloutB))
+}
+
+func TestRolloutCacheKeyFallsBackToNamespaceName(t *testing.T) {
+	withUID := &rolloutsv1alpha1.Rollout{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "a", UID: types.UID("uid-a")}}
+	assert.Equal(t, "uid-a", rolloutCacheKey(withUID))
+
+	withoutUID := &rolloutsv1alpha1.Rollout{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "a"}}
+	assert.Equal(t, "default/a", rolloutCacheKey(withoutUID))
+}
+
+func TestParseDestinationFields(t *testing.T) {
+	cm := &corev1.ConfigMap{Data: map[string]string{
+		destinationFieldsConfigMapKey: `
+slack/bot:
+  - replicaSets
+  - cluster
+`,
+	}}
+
+	fields := parseDestinationFields(cm)
+	assert.Equal(t, []string{"replicaSets", "cluster"}, fields["slack/bot"])
+}
+
+func TestParseDestinationFieldsNoKey(t *testing.T) {
+	fields := parseDestinationFields(&corev1.ConfigMap{})
+	assert.Empty(t, fields)
+}
+
+func TestDestKey(t *testing.T) {
+	dest := services.Destination{Service: "slack", Recipient: "bot"}
+	assert.Equal(t, "slack/bot", destKey(dest))
+}
+
+func TestToRollout(t *testing.T) {
+	obj := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "a", "namespace": "default"},
+	}
+	rollout, err := toRollout(obj)
+	require.NoError(t, err)
+	assert.Equal(t, "a", rollout.Name)
+	assert.Equal(t, "default", rollout.Namespace)
+}